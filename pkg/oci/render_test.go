@@ -0,0 +1,208 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+	mode     int64
+}
+
+func buildTar(entries []tarEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Size:     int64(len(e.body)),
+			Mode:     mode,
+		}
+		if hdr.Typeflag == 0 {
+			hdr.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			panic(err)
+		}
+		if e.body != "" {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				panic(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	return &buf
+}
+
+func TestExtractLayerRejectsTarSlip(t *testing.T) {
+	root, err := ioutil.TempDir("", "rkt-oci-render-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// nest the extraction root two levels down so "../.." lands in root
+	dir := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r := buildTar([]tarEntry{
+		{name: "../../etc/passwd", body: "pwned"},
+	})
+	if err := extractLayer(r, dir); err == nil {
+		t.Error("extractLayer should refuse an entry that escapes the extraction root")
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc", "passwd")); !os.IsNotExist(err) {
+		t.Error("extractLayer must not have written outside the extraction root")
+	}
+}
+
+func TestExtractLayerRejectsSymlinkRedirection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-oci-render-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outside, err := ioutil.TempDir("", "rkt-oci-render-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	// A symlink named "escape" pointing out of dir, then a later entry
+	// whose own name has no ".." in it but traverses that symlink.
+	r := buildTar([]tarEntry{
+		{name: "escape", typeflag: tar.TypeSymlink, linkname: outside},
+		{name: "escape/pwned.txt", body: "pwned"},
+	})
+	if err := extractLayer(r, dir); err == nil {
+		t.Error("extractLayer should refuse an entry that traverses a symlink planted by an earlier entry")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "pwned.txt")); !os.IsNotExist(err) {
+		t.Error("extractLayer must not have written through the symlink to outside dir")
+	}
+}
+
+func TestExtractLayerRegularFileAndWhiteout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-oci-render-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := buildTar([]tarEntry{
+		{name: "foo.txt", body: "hello"},
+	})
+	if err := extractLayer(r, dir); err != nil {
+		t.Fatalf("extractLayer: %v", err)
+	}
+	got, err := ioutil.ReadFile(filepath.Join(dir, "foo.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("foo.txt = %q, want %q", got, "hello")
+	}
+
+	r = buildTar([]tarEntry{
+		{name: ".wh.foo.txt"},
+	})
+	if err := extractLayer(r, dir); err != nil {
+		t.Fatalf("extractLayer: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "foo.txt")); !os.IsNotExist(err) {
+		t.Error("whiteout entry should have removed foo.txt")
+	}
+}
+
+func TestExtractLayerOpaqueDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-oci-render-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := buildTar([]tarEntry{
+		{name: "sub", typeflag: tar.TypeDir},
+		{name: "sub/a.txt", body: "a"},
+		{name: "sub/b.txt", body: "b"},
+	})
+	if err := extractLayer(r, dir); err != nil {
+		t.Fatalf("extractLayer: %v", err)
+	}
+
+	r = buildTar([]tarEntry{
+		{name: "sub/.wh..wh..opq"},
+		{name: "sub/c.txt", body: "c"},
+	})
+	if err := extractLayer(r, dir); err != nil {
+		t.Fatalf("extractLayer: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "sub", "a.txt")); !os.IsNotExist(err) {
+		t.Error("opaque whiteout should have emptied sub/ of earlier entries")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "b.txt")); !os.IsNotExist(err) {
+		t.Error("opaque whiteout should have emptied sub/ of earlier entries")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "sub", "c.txt")); err != nil {
+		t.Error("opaque whiteout must not remove entries from its own layer")
+	}
+}
+
+func TestExtractLayerHardlinkResolvesAgainstRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-oci-render-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := buildTar([]tarEntry{
+		{name: "a/b", typeflag: tar.TypeDir},
+		{name: "a/b/target.txt", body: "linked content"},
+		{name: "a/c", typeflag: tar.TypeDir},
+		{name: "a/c/link.txt", typeflag: tar.TypeLink, linkname: "a/b/target.txt"},
+	})
+	if err := extractLayer(r, dir); err != nil {
+		t.Fatalf("extractLayer: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(dir, "a", "c", "link.txt"))
+	if err != nil {
+		t.Fatalf("hardlink target not resolved correctly: %v", err)
+	}
+	if string(got) != "linked content" {
+		t.Errorf("a/c/link.txt = %q, want %q", got, "linked content")
+	}
+}
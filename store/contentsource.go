@@ -0,0 +1,33 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import "io"
+
+// ContentSource is a remote content-addressable backend that Store can
+// consult on a local cache miss, and optionally publish newly imported
+// blobs to. Keys are always in Store's own "<algo>-<hex>" form (see
+// HashAlgo); it's up to the implementation to translate to/from whatever
+// addressing its backend uses.
+type ContentSource interface {
+	// Has reports whether the backend currently holds the blob for key.
+	Has(key string) (bool, error)
+	// Get returns a reader for the blob identified by key. Callers must
+	// close the returned ReadCloser.
+	Get(key string) (io.ReadCloser, error)
+	// Put publishes the blob read from r under key. Read-only sources
+	// (e.g. a plain HTTP gateway) should return an error.
+	Put(key string, r io.Reader) error
+}
@@ -0,0 +1,451 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/coreos/rkt/pkg/lock"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/pkg/acirenderer"
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/peterbourgon/diskv"
+)
+
+// GCOptions configure a Store.GC pass.
+type GCOptions struct {
+	// DryRun reports what GC would remove without removing anything.
+	DryRun bool
+	// GracePeriod keeps a blob from being collected until it's been on
+	// disk for at least this long, so an ACI mid-import can't be yanked
+	// out from under a concurrent WriteACI/RenderTreeStore.
+	GracePeriod time.Duration
+	// MaxBytes, if non-zero, is a target for the total size of the blob
+	// store: once orphans and expired-grace-period blobs are collected,
+	// if the store is still over MaxBytes, GC evicts whole ACIs
+	// oldest-imported-first, skipping any still depended on by another
+	// ACI, until it's under quota or nothing more can safely go.
+	MaxBytes int64
+}
+
+// GCReport summarizes what a Store.GC pass removed (or, with DryRun, would
+// have removed).
+type GCReport struct {
+	RemovedACIKeys       []string
+	RemovedTreeStoreKeys []string
+	RemovedBytes         int64
+}
+
+// GC walks the blob, imageManifest and tree stores, removing data that's
+// no longer reachable from any ACIInfo: blobs left behind by a RemoveACI
+// that failed partway through (see the TODO on RemoveACI), and, if
+// opts.MaxBytes is exceeded, whole ACIs evicted oldest-first. It runs
+// under an exclusive store lock, after checking the db is at the expected
+// version, so it never races a concurrent WriteACI or a store migration.
+func (s Store) GC(opts GCOptions) (GCReport, error) {
+	if err := s.db.Do(func(tx *sql.Tx) error {
+		version, err := getDBVersion(tx)
+		if err != nil {
+			return err
+		}
+		if version != dbVersion {
+			return fmt.Errorf("store db version %d, expected %d; refusing to GC", version, dbVersion)
+		}
+		return nil
+	}); err != nil {
+		return GCReport{}, err
+	}
+
+	if err := s.storeLock.ExclusiveLock(); err != nil {
+		return GCReport{}, fmt.Errorf("error locking store: %v", err)
+	}
+	defer s.storeLock.Unlock()
+
+	aciInfos, err := s.GetAllACIInfos([]string{"importtime"}, true)
+	if err != nil {
+		return GCReport{}, fmt.Errorf("error listing ACI infos: %v", err)
+	}
+	byKey := make(map[string]struct{}, len(aciInfos))
+	for _, info := range aciInfos {
+		byKey[info.BlobKey] = struct{}{}
+	}
+	ociKeys, err := gcOCIReachableKeys(s)
+	if err != nil {
+		return GCReport{}, fmt.Errorf("error listing OCI image infos: %v", err)
+	}
+	for k := range ociKeys {
+		byKey[k] = struct{}{}
+	}
+
+	refcount, err := gcRefcounts(s, aciInfos)
+	if err != nil {
+		return GCReport{}, fmt.Errorf("error resolving dependency graph: %v", err)
+	}
+
+	var report GCReport
+
+	for _, si := range []int64{blobType, imageManifestType} {
+		removed, bytes, err := gcOrphans(s.stores[si], s.imageLockDir, byKey, opts)
+		if err != nil {
+			return report, err
+		}
+		report.RemovedACIKeys = append(report.RemovedACIKeys, removed...)
+		report.RemovedBytes += bytes
+	}
+
+	reachableLayerKeys, err := gcReachableLayerKeys(s, aciInfos)
+	if err != nil {
+		return GCReport{}, fmt.Errorf("error resolving layer dependency graph: %v", err)
+	}
+
+	removedTrees, err := gcOrphanTrees(s.treestore, s.treeStoreLockDir, byKey, reachableLayerKeys, opts)
+	if err != nil {
+		return report, err
+	}
+	report.RemovedTreeStoreKeys = removedTrees
+
+	if opts.MaxBytes > 0 {
+		evicted, bytes, err := s.gcEnforceQuota(aciInfos, refcount, opts)
+		if err != nil {
+			return report, err
+		}
+		report.RemovedACIKeys = append(report.RemovedACIKeys, evicted...)
+		report.RemovedBytes += bytes
+	}
+
+	return report, nil
+}
+
+// gcRefcounts resolves every ACI's dependency chain and returns, per CAS
+// key, how many other known ACIs depend on it. An ACI with a zero count is
+// one nothing else in the store needs — a candidate for quota eviction.
+func gcRefcounts(ap acirenderer.ACIRegistry, aciInfos []*ACIInfo) (map[string]int, error) {
+	refcount := map[string]int{}
+	for _, info := range aciInfos {
+		if _, ok := refcount[info.BlobKey]; !ok {
+			refcount[info.BlobKey] = 0
+		}
+		deps, err := acirenderer.CreateDepListFromImageID(info.BlobKey, ap)
+		if err != nil {
+			// A broken or partially-imported dependency chain
+			// shouldn't abort the whole GC; worst case we're
+			// conservative and leave something behind an extra cycle.
+			continue
+		}
+		for _, d := range deps {
+			if d.Key == info.BlobKey {
+				continue
+			}
+			refcount[d.Key]++
+		}
+	}
+	return refcount, nil
+}
+
+// gcOCIReachableKeys returns the CAS keys of every blob an imported OCI
+// image still needs: its config blob, its manifest blob, and every layer
+// the manifest currently lists. OCI blobs and OCI-rendered trees share the
+// same blobType store and tree store directories ACI data does, so
+// without this, gcOrphans/gcOrphanTrees would see every OCI image as
+// unreferenced (OCIImageInfo isn't an ACIInfo) and delete it.
+func gcOCIReachableKeys(s Store) (map[string]struct{}, error) {
+	var infos []*OCIImageInfo
+	if err := s.db.Do(func(tx *sql.Tx) error {
+		var err error
+		infos, err = GetAllOCIImageInfos(tx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]struct{}, len(infos))
+	for _, info := range infos {
+		keys[info.BlobKey] = struct{}{}
+
+		manifestKey, err := ociDigestToKey(info.ManifestDigest)
+		if err != nil {
+			continue
+		}
+		keys[manifestKey] = struct{}{}
+
+		rawManifest, err := s.stores[blobType].Read(manifestKey)
+		if err != nil {
+			// Manifest blob already gone; nothing more of this image can
+			// be marked reachable, so GC may claim the rest too. That's
+			// only reached if the manifest itself was already lost, which
+			// a healthy store never does outside of manual tampering.
+			continue
+		}
+		var manifest ociManifest
+		if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+			continue
+		}
+		for _, l := range manifest.Layers {
+			if k, err := ociDigestToKey(l.Digest); err == nil {
+				keys[k] = struct{}{}
+			}
+		}
+	}
+	return keys, nil
+}
+
+// gcOrphans removes every key in d that has no matching ACIInfo (or
+// OCIImageInfo-derived) entry in byKey, i.e. blobs left behind by a
+// RemoveACI that failed to clean up its non-transactional stores.
+func gcOrphans(d *diskv.Diskv, lockDir string, byKey map[string]struct{}, opts GCOptions) ([]string, int64, error) {
+	var removed []string
+	var total int64
+	for key := range d.Keys(nil) {
+		if _, ok := byKey[key]; ok {
+			continue
+		}
+		fi, err := os.Stat(blobFilePath(d, key))
+		if err != nil {
+			continue
+		}
+		if opts.GracePeriod > 0 && time.Since(fi.ModTime()) < opts.GracePeriod {
+			continue
+		}
+		if opts.DryRun {
+			removed = append(removed, key)
+			total += fi.Size()
+			continue
+		}
+		keyLock, err := lock.ExclusiveKeyLock(lockDir, key)
+		if err != nil {
+			continue
+		}
+		err = d.Erase(key)
+		keyLock.Close()
+		if err != nil {
+			continue
+		}
+		removed = append(removed, key)
+		total += fi.Size()
+	}
+	return removed, total, nil
+}
+
+// gcOrphanTrees removes rendered tree store directories whose key isn't in
+// byKey, taking the per-key tree store lock so an in-flight
+// RenderTreeStore is never yanked out from under a reader. The shared
+// layer cache (treeStoreLayersDirName) lives as its own entry directly
+// under the tree store root, so it's never itself an ACI/OCI key in
+// byKey; it's swept separately, entry-by-entry, by gcOrphanLayers.
+func gcOrphanTrees(ts *TreeStore, lockDir string, byKey, reachableLayerKeys map[string]struct{}, opts GCOptions) ([]string, error) {
+	entries, err := ioutil.ReadDir(ts.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var removed []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		key := e.Name()
+		if key == treeStoreLayersDirName {
+			layerRemoved, err := gcOrphanLayers(ts, lockDir, reachableLayerKeys, opts)
+			if err != nil {
+				return removed, err
+			}
+			removed = append(removed, layerRemoved...)
+			continue
+		}
+		if _, ok := byKey[key]; ok {
+			continue
+		}
+		if opts.GracePeriod > 0 && time.Since(e.ModTime()) < opts.GracePeriod {
+			continue
+		}
+		if opts.DryRun {
+			removed = append(removed, key)
+			continue
+		}
+		treeLock, err := lock.ExclusiveKeyLock(lockDir, key)
+		if err != nil {
+			continue
+		}
+		err = ts.Remove(key)
+		treeLock.Close()
+		if err != nil {
+			continue
+		}
+		removed = append(removed, key)
+	}
+	return removed, nil
+}
+
+// gcOrphanLayers removes shared layer directories under tree/layers that
+// no longer belong to any live ACI's dependency chain. It locks each
+// candidate with the same "layer-"+key name renderLayer itself locks (see
+// store/overlay.go), so this is properly serialized against a concurrent
+// renderLayer/MountTreeStore instead of racing it under the single
+// "layers" name gcOrphanTrees' own per-key lock would otherwise take.
+func gcOrphanLayers(ts *TreeStore, lockDir string, reachableLayerKeys map[string]struct{}, opts GCOptions) ([]string, error) {
+	layersDir := filepath.Join(ts.path, treeStoreLayersDirName)
+	entries, err := ioutil.ReadDir(layersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var removed []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		key := e.Name()
+		if _, ok := reachableLayerKeys[key]; ok {
+			continue
+		}
+		if opts.GracePeriod > 0 && time.Since(e.ModTime()) < opts.GracePeriod {
+			continue
+		}
+		if opts.DryRun {
+			removed = append(removed, key)
+			continue
+		}
+		layerLock, err := lock.ExclusiveKeyLock(lockDir, "layer-"+key)
+		if err != nil {
+			continue
+		}
+		err = os.RemoveAll(filepath.Join(layersDir, key))
+		layerLock.Close()
+		if err != nil {
+			continue
+		}
+		removed = append(removed, key)
+	}
+	return removed, nil
+}
+
+// gcReachableLayerKeys returns the CAS key of every ACI that still has a
+// shared layer directory under tree/layers: every dependency (including
+// itself) of every live ACI, exactly the set renderLayer has ever been, or
+// would ever be, asked to extract for one of them.
+func gcReachableLayerKeys(ap acirenderer.ACIRegistry, aciInfos []*ACIInfo) (map[string]struct{}, error) {
+	keys := make(map[string]struct{})
+	for _, info := range aciInfos {
+		deps, err := acirenderer.CreateDepListFromImageID(info.BlobKey, ap)
+		if err != nil {
+			// Same reasoning as gcRefcounts: a broken dependency chain
+			// shouldn't abort GC; worst case we're conservative and leave
+			// a layer behind an extra cycle.
+			continue
+		}
+		for _, d := range deps {
+			keys[d.Key] = struct{}{}
+		}
+	}
+	return keys, nil
+}
+
+// gcEnforceQuota evicts whole ACIs, oldest ImportTime first, skipping any
+// with a non-zero refcount (still depended on by another ACI), until the
+// blob store is at or under opts.MaxBytes or there's nothing left that can
+// safely be removed.
+func (s Store) gcEnforceQuota(aciInfos []*ACIInfo, refcount map[string]int, opts GCOptions) ([]string, int64, error) {
+	total, err := gcStoreSize(s.stores[blobType])
+	if err != nil {
+		return nil, 0, err
+	}
+	if total <= opts.MaxBytes {
+		return nil, 0, nil
+	}
+
+	byAge := make(aciInfosByImportTime, len(aciInfos))
+	copy(byAge, aciInfos)
+	sort.Sort(byAge)
+
+	var removed []string
+	var freed int64
+	for _, info := range byAge {
+		if total <= opts.MaxBytes {
+			break
+		}
+		if refcount[info.BlobKey] > 0 {
+			continue
+		}
+		size, err := blobFileSize(s.stores[blobType], info.BlobKey)
+		if err != nil {
+			continue
+		}
+		if opts.GracePeriod > 0 {
+			fi, err := os.Stat(blobFilePath(s.stores[blobType], info.BlobKey))
+			if err != nil || time.Since(fi.ModTime()) < opts.GracePeriod {
+				continue
+			}
+		}
+		if opts.DryRun {
+			removed = append(removed, info.BlobKey)
+			freed += size
+			total -= size
+			continue
+		}
+		if err := s.RemoveACI(info.BlobKey); err != nil {
+			continue
+		}
+		removed = append(removed, info.BlobKey)
+		freed += size
+		total -= size
+	}
+	return removed, freed, nil
+}
+
+// aciInfosByImportTime sorts ACIInfos oldest first.
+type aciInfosByImportTime []*ACIInfo
+
+func (a aciInfosByImportTime) Len() int           { return len(a) }
+func (a aciInfosByImportTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a aciInfosByImportTime) Less(i, j int) bool { return a[i].ImportTime.Before(a[j].ImportTime) }
+
+func gcStoreSize(d *diskv.Diskv) (int64, error) {
+	var total int64
+	for key := range d.Keys(nil) {
+		fi, err := os.Stat(blobFilePath(d, key))
+		if err != nil {
+			continue
+		}
+		total += fi.Size()
+	}
+	return total, nil
+}
+
+func blobFileSize(d *diskv.Diskv, key string) (int64, error) {
+	fi, err := os.Stat(blobFilePath(d, key))
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// blobFilePath returns the on-disk path diskv uses for key, using the same
+// blockTransform the store's diskv instances are configured with.
+func blobFilePath(d *diskv.Diskv, key string) string {
+	dirs := append([]string{d.BasePath}, blockTransform(key)...)
+	return filepath.Join(filepath.Join(dirs...), key)
+}
@@ -0,0 +1,39 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestACIInfosByImportTimeSortsOldestFirst(t *testing.T) {
+	now := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	infos := aciInfosByImportTime{
+		{BlobKey: "c", ImportTime: now.Add(2 * time.Hour)},
+		{BlobKey: "a", ImportTime: now},
+		{BlobKey: "b", ImportTime: now.Add(time.Hour)},
+	}
+
+	sort.Sort(infos)
+
+	want := []string{"a", "b", "c"}
+	for i, info := range infos {
+		if info.BlobKey != want[i] {
+			t.Errorf("infos[%d].BlobKey = %q, want %q", i, info.BlobKey, want[i])
+		}
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+	"github.com/coreos/rkt/Godeps/_workspace/src/golang.org/x/crypto/blake2b"
+)
+
+// HashAlgo identifies the digest algorithm a CAS key was computed with.
+// It's persisted as a single byte alongside each ACIInfo row so ResolveKey
+// can tell apart, say, a "sha256-ab…" prefix from a "sha512-ab…" one
+// without guessing from the key string alone.
+type HashAlgo byte
+
+const (
+	// HashAlgoSHA512 is the default, backward-compatible algorithm: keys
+	// are truncated to half the raw digest for shorter blob store paths.
+	HashAlgoSHA512 HashAlgo = iota
+	// HashAlgoSHA256 keys are kept full-length, matching the OCI blobs
+	// WriteOCI already stores this way (see ociHashPrefix).
+	HashAlgoSHA256
+	// HashAlgoBlake2b256 keys are also kept full-length.
+	HashAlgoBlake2b256
+)
+
+func (a HashAlgo) String() string {
+	switch a {
+	case HashAlgoSHA512:
+		return "sha512"
+	case HashAlgoSHA256:
+		return "sha256"
+	case HashAlgoBlake2b256:
+		return "blake2b-256"
+	default:
+		return "unknown"
+	}
+}
+
+// hashAlgoFromString parses the algorithm name used in a CAS key prefix
+// (everything before the trailing "-").
+func hashAlgoFromString(s string) (HashAlgo, error) {
+	switch s {
+	case "sha512":
+		return HashAlgoSHA512, nil
+	case "sha256":
+		return HashAlgoSHA256, nil
+	case "blake2b-256":
+		return HashAlgoBlake2b256, nil
+	default:
+		return 0, fmt.Errorf("unknown hash algorithm: %q", s)
+	}
+}
+
+// prefix returns the CAS key prefix for a, e.g. "sha512-".
+func (a HashAlgo) prefix() string {
+	return a.String() + "-"
+}
+
+// rawSize is the algorithm's raw digest size in bytes.
+func (a HashAlgo) rawSize() int {
+	switch a {
+	case HashAlgoSHA512:
+		return sha512.Size
+	case HashAlgoSHA256:
+		return sha256.Size
+	case HashAlgoBlake2b256:
+		return 32
+	default:
+		return 0
+	}
+}
+
+// fullKeyLen is the length of a complete (non-abbreviated) key for a.
+// sha512 keeps rkt's long-standing half-length truncation, kept for
+// on-disk backward compatibility with existing stores; the newer
+// algorithms are stored full-length.
+func (a HashAlgo) fullKeyLen() int {
+	if a == HashAlgoSHA512 {
+		return lenKey
+	}
+	return len(a.prefix()) + hex.EncodedLen(a.rawSize())
+}
+
+// new returns a fresh hash.Hash for a.
+func (a HashAlgo) new() (hash.Hash, error) {
+	switch a {
+	case HashAlgoSHA512:
+		return sha512.New(), nil
+	case HashAlgoSHA256:
+		return sha256.New(), nil
+	case HashAlgoBlake2b256:
+		return blake2b.New256(nil)
+	default:
+		return nil, fmt.Errorf("unknown hash algorithm: %d", a)
+	}
+}
+
+// multihashCode is a's code in the multihash namespace, used to translate
+// a CAS key to/from the CIDs content sources like IPFS address blocks by.
+func (a HashAlgo) multihashCode() (int, error) {
+	switch a {
+	case HashAlgoSHA512:
+		return multihash.SHA2_512, nil
+	case HashAlgoSHA256:
+		return multihash.SHA2_256, nil
+	case HashAlgoBlake2b256:
+		code, ok := multihash.Names[a.String()]
+		if !ok {
+			return 0, fmt.Errorf("multihash package doesn't know %q", a.String())
+		}
+		return code, nil
+	default:
+		return 0, fmt.Errorf("unknown hash algorithm: %d", a)
+	}
+}
+
+// multihashName is the name IPFS's HTTP API expects for its mhtype query
+// parameter, which (unlike HashAlgo.String) follows the multihash spec's
+// own naming rather than Go's crypto package names.
+func (a HashAlgo) multihashName() (string, error) {
+	switch a {
+	case HashAlgoSHA512:
+		return "sha2-512", nil
+	case HashAlgoSHA256:
+		return "sha2-256", nil
+	case HashAlgoBlake2b256:
+		return "blake2b-256", nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm: %d", a)
+	}
+}
+
+// algoFromMultihashCode is the reverse of multihashCode, used to translate
+// a multihash-encoded CID (e.g. from IPFS) back to a Store HashAlgo.
+func algoFromMultihashCode(code int) (HashAlgo, error) {
+	for _, a := range allHashAlgos {
+		c, err := a.multihashCode()
+		if err == nil && c == code {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported multihash code: %#x", code)
+}
+
+// allHashAlgos is the set ResolveKey tries a key's prefix against. None of
+// the prefixes is a prefix of another, so at most one of them matches a
+// given key.
+var allHashAlgos = []HashAlgo{HashAlgoBlake2b256, HashAlgoSHA256, HashAlgoSHA512}
+
+// algoForKey identifies which algorithm produced key, from its prefix.
+func algoForKey(key string) (HashAlgo, error) {
+	for _, a := range allHashAlgos {
+		if strings.HasPrefix(key, a.prefix()) {
+			return a, nil
+		}
+	}
+	return 0, fmt.Errorf("wrong key prefix")
+}
+
+// fullKeyDigest decodes key's hex digest and returns it along with its
+// algorithm, refusing a truncated one: the default HashAlgoSHA512 keeps
+// only half of its raw digest (see lenHashKey), which isn't enough bytes
+// to be anybody's real hash of anything, let alone this content's.
+// Callers that need to relate a key to a true content digest — e.g. to
+// compute or verify a multihash CID — must go through this rather than
+// decoding key's hex themselves.
+func fullKeyDigest(key string) (HashAlgo, []byte, error) {
+	algo, err := algoForKey(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	h, err := hex.DecodeString(key[len(algo.prefix()):])
+	if err != nil {
+		return 0, nil, fmt.Errorf("error decoding key: %v", err)
+	}
+	if len(h) != algo.rawSize() {
+		return 0, nil, fmt.Errorf("key %q is truncated; need the full untruncated digest", key)
+	}
+	return algo, h, nil
+}
+
+// keyToStringAlgo formats a raw digest sum as a CAS key for algo,
+// truncating it if algo uses rkt's legacy half-length sha512 form.
+func keyToStringAlgo(algo HashAlgo, sum []byte) string {
+	full := fmt.Sprintf("%s%x", algo.prefix(), sum)
+	if n := algo.fullKeyLen(); len(full) > n {
+		return full[:n]
+	}
+	return full
+}
+
+// hashToKeyAlgo takes a hash.Hash (already Write()'n the full content) and
+// returns the CAS key for it under algo.
+func hashToKeyAlgo(algo HashAlgo, h hash.Hash) string {
+	return keyToStringAlgo(algo, h.Sum(nil))
+}
+
+// migrateACIInfoAlgoColumn adds the aciinfo.algo column HashAlgo support
+// needs, if it isn't there already. It's idempotent (safe to run on every
+// migration pass, not just once at the version that introduced it) and
+// uses "DEFAULT 0" rather than a separate backfill UPDATE: 0 is
+// HashAlgoSHA512, and every row written before this column existed was
+// necessarily written by the old, sha512-only WriteACI, so SQLite filling
+// existing rows with the column default is already the correct backfill.
+func migrateACIInfoAlgoColumn(tx *sql.Tx) error {
+	rows, err := tx.Query(`PRAGMA table_info(aciinfo)`)
+	if err != nil {
+		return fmt.Errorf("error inspecting aciinfo schema: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			ctype     string
+			notnull   int
+			dfltValue interface{}
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk); err != nil {
+			return fmt.Errorf("error reading aciinfo schema: %v", err)
+		}
+		if name == "algo" {
+			return rows.Err()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error reading aciinfo schema: %v", err)
+	}
+
+	if _, err := tx.Exec(`ALTER TABLE aciinfo ADD COLUMN algo integer NOT NULL DEFAULT 0`); err != nil {
+		return fmt.Errorf("error adding aciinfo.algo column: %v", err)
+	}
+	return nil
+}
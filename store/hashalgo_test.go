@@ -0,0 +1,99 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import "testing"
+
+func TestHashAlgoPrefixAndFullKeyLen(t *testing.T) {
+	for _, tt := range []struct {
+		algo       HashAlgo
+		wantPrefix string
+		truncated  bool
+	}{
+		{HashAlgoSHA512, "sha512-", true},
+		{HashAlgoSHA256, "sha256-", false},
+		{HashAlgoBlake2b256, "blake2b-256-", false},
+	} {
+		if got := tt.algo.prefix(); got != tt.wantPrefix {
+			t.Errorf("%v.prefix() = %q, want %q", tt.algo, got, tt.wantPrefix)
+		}
+		full := tt.algo.fullKeyLen()
+		untruncatedLen := len(tt.wantPrefix) + tt.algo.rawSize()*2
+		if tt.truncated && full >= untruncatedLen {
+			t.Errorf("%v.fullKeyLen() = %d, want less than untruncated length %d", tt.algo, full, untruncatedLen)
+		}
+		if !tt.truncated && full != untruncatedLen {
+			t.Errorf("%v.fullKeyLen() = %d, want %d", tt.algo, full, untruncatedLen)
+		}
+	}
+}
+
+func TestHashAlgoNewAndKeyRoundTrip(t *testing.T) {
+	for _, algo := range allHashAlgos {
+		h, err := algo.new()
+		if err != nil {
+			t.Fatalf("%v.new(): %v", algo, err)
+		}
+		h.Write([]byte("hello rkt"))
+		key := hashToKeyAlgo(algo, h)
+
+		gotAlgo, err := algoForKey(key)
+		if err != nil {
+			t.Fatalf("algoForKey(%q): %v", key, err)
+		}
+		if gotAlgo != algo {
+			t.Errorf("algoForKey(%q) = %v, want %v", key, gotAlgo, algo)
+		}
+	}
+}
+
+func TestAlgoForKeyUnknownPrefix(t *testing.T) {
+	if _, err := algoForKey("md5-deadbeef"); err == nil {
+		t.Error("algoForKey with an unsupported prefix should fail")
+	}
+}
+
+func TestFullKeyDigestRejectsTruncatedSHA512(t *testing.T) {
+	h, err := HashAlgoSHA512.new()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("some aci content"))
+	key := hashToKeyAlgo(HashAlgoSHA512, h) // truncated, the default on-disk form
+
+	if _, _, err := fullKeyDigest(key); err == nil {
+		t.Errorf("fullKeyDigest(%q) should reject a truncated sha512 key", key)
+	}
+}
+
+func TestFullKeyDigestAcceptsFullLengthKey(t *testing.T) {
+	h, err := HashAlgoSHA256.new()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("some aci content"))
+	key := hashToKeyAlgo(HashAlgoSHA256, h) // sha256 keys aren't truncated
+
+	algo, digest, err := fullKeyDigest(key)
+	if err != nil {
+		t.Fatalf("fullKeyDigest(%q): %v", key, err)
+	}
+	if algo != HashAlgoSHA256 {
+		t.Errorf("fullKeyDigest(%q) algo = %v, want %v", key, algo, HashAlgoSHA256)
+	}
+	if len(digest) != HashAlgoSHA256.rawSize() {
+		t.Errorf("fullKeyDigest(%q) digest len = %d, want %d", key, len(digest), HashAlgoSHA256.rawSize())
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/jbenet/go-multihash"
+)
+
+const (
+	// envIPFSAPI overrides the IPFS API endpoint used by the default
+	// IPFSSource registered by NewStore.
+	envIPFSAPI = "RKT_IPFS_API"
+
+	// defaultIPFSAPI is used when neither envIPFSAPI nor an explicit
+	// api argument to NewIPFSSource is set.
+	defaultIPFSAPI = "http://localhost:5001"
+
+	// ipfsMaxBlockSize is the largest blob IPFSSource.Put will announce as
+	// a single raw block, matching go-ipfs's own default block size
+	// ceiling. Announcing anything bigger needs a proper merkledag/UnixFS
+	// writer, which this source doesn't implement.
+	ipfsMaxBlockSize = 1 << 20 // 1MiB
+)
+
+// IPFSSource is a ContentSource backed by an IPFS node. It can talk to
+// either the daemon's HTTP API (read-write) or a plain HTTPS gateway
+// (read-only, for environments where only gateway access is available).
+type IPFSSource struct {
+	api      string
+	readOnly bool
+	client   *http.Client
+}
+
+// NewIPFSSource returns an IPFSSource talking to api, which may be a daemon
+// API endpoint (e.g. "http://localhost:5001") or an HTTPS gateway (e.g.
+// "https://ipfs.io"). If api is empty, RKT_IPFS_API is consulted, falling
+// back to defaultIPFSAPI. HTTPS endpoints not already pointing at an API
+// path are assumed to be read-only gateways, since gateways don't expose
+// block/put.
+func NewIPFSSource(api string) *IPFSSource {
+	if api == "" {
+		api = os.Getenv(envIPFSAPI)
+	}
+	if api == "" {
+		api = defaultIPFSAPI
+	}
+	api = strings.TrimRight(api, "/")
+	readOnly := strings.HasPrefix(api, "https://") && !strings.Contains(api, "/api/v0")
+	return &IPFSSource{
+		api:      api,
+		readOnly: readOnly,
+		client:   http.DefaultClient,
+	}
+}
+
+func (s *IPFSSource) Has(key string) (bool, error) {
+	cid, err := keyToCID(key)
+	if err != nil {
+		return false, err
+	}
+	var u string
+	if s.readOnly {
+		u = s.gatewayURL(cid)
+	} else {
+		u = s.api + "/api/v0/block/stat?arg=" + cid
+	}
+	req, err := http.NewRequest("HEAD", u, nil)
+	if err != nil {
+		return false, err
+	}
+	if !s.readOnly {
+		// block/stat doesn't support HEAD, it's a GET-only RPC endpoint
+		req.Method = "GET"
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+func (s *IPFSSource) Get(key string) (io.ReadCloser, error) {
+	cid, err := keyToCID(key)
+	if err != nil {
+		return nil, err
+	}
+	u := s.gatewayURL(cid)
+	if !s.readOnly {
+		u = s.api + "/api/v0/block/get?arg=" + cid
+	}
+	log.Printf("GET %v", u)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	// IPFS likes to slam the socket shut, triggering
+	// https://github.com/golang/go/issues/8946
+	req.Close = true
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("http error: %v", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+func (s *IPFSSource) Put(key string, r io.Reader) error {
+	if s.readOnly {
+		return errors.New("ipfs source is read-only (gateway mode)")
+	}
+	// format=raw (no dag-pb wrapping) with mhtype matching key's own
+	// algorithm makes IPFS hash the block exactly the way HashToKeyAlgo
+	// did, so the CID it assigns is the very one keyToCID derives from
+	// key: without this, Get's lookup could never find what Put stored.
+	// fullKeyDigest also refuses a truncated key up front: there's no
+	// point publishing a block nothing can ever be resolved back to.
+	algo, _, err := fullKeyDigest(key)
+	if err != nil {
+		return err
+	}
+	mhName, err := algo.multihashName()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, err := mw.CreateFormFile("file", "block")
+	if err != nil {
+		return err
+	}
+	// block/put stores key's content as a single raw IPFS block; it has
+	// no way to shard a blob bigger than one block across a DAG the way
+	// "ipfs add" does. Building that DAG ourselves (and getting Get's
+	// read path to reassemble it) is real work this source doesn't do
+	// yet, so refuse up front rather than silently truncate or let the
+	// daemon fail the upload block-by-block.
+	n, err := io.Copy(fw, io.LimitReader(r, ipfsMaxBlockSize+1))
+	if err != nil {
+		return err
+	}
+	if n > ipfsMaxBlockSize {
+		return fmt.Errorf("ipfs: blob for %q is larger than the %d-byte single-block limit; piecewise DAG announce isn't implemented", key, ipfsMaxBlockSize)
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/api/v0/block/put?format=raw&mhtype=%s", s.api, mhName)
+	req, err := http.NewRequest("POST", u, &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("ipfs block/put failed: %v: %s", resp.Status, body)
+	}
+	return nil
+}
+
+func (s *IPFSSource) gatewayURL(cid string) string {
+	if strings.HasSuffix(s.api, "/ipfs") {
+		return s.api + "/" + cid
+	}
+	return s.api + "/ipfs/" + cid
+}
+
+// keyToCID translates a Store key (of the form "<algo>-<hex>", see
+// HashAlgo) into the base58 CID form used on the IPFS swarm.
+func keyToCID(key string) (string, error) {
+	algo, h, err := fullKeyDigest(key)
+	if err != nil {
+		return "", err
+	}
+	code, err := algo.multihashCode()
+	if err != nil {
+		return "", err
+	}
+	mhbuf, err := multihash.Encode(h, code)
+	if err != nil {
+		return "", fmt.Errorf("error encoding multihash: %v", err)
+	}
+	mh, err := multihash.Cast(mhbuf)
+	if err != nil {
+		return "", fmt.Errorf("error casting multihash: %v", err)
+	}
+	// b58 will never require quoting
+	return mh.B58String(), nil
+}
+
+// cidToKey translates a base58 IPFS CID back into a Store key.
+func cidToKey(cid string) (string, error) {
+	mh, err := multihash.FromB58String(cid)
+	if err != nil {
+		return "", fmt.Errorf("error decoding CID: %v", err)
+	}
+	dmh, err := multihash.Decode(mh)
+	if err != nil {
+		return "", fmt.Errorf("error decoding multihash: %v", err)
+	}
+	algo, err := algoFromMultihashCode(dmh.Code)
+	if err != nil {
+		return "", fmt.Errorf("error translating CID: %v", err)
+	}
+	return keyToStringAlgo(algo, dmh.Digest), nil
+}
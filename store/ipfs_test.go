@@ -0,0 +1,78 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyToCIDRoundTrip(t *testing.T) {
+	for _, algo := range []HashAlgo{HashAlgoSHA256, HashAlgoBlake2b256} {
+		h, err := algo.new()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Write([]byte("announce me"))
+		key := hashToKeyAlgo(algo, h)
+
+		cid, err := keyToCID(key)
+		if err != nil {
+			t.Fatalf("keyToCID(%q): %v", key, err)
+		}
+		got, err := cidToKey(cid)
+		if err != nil {
+			t.Fatalf("cidToKey(%q): %v", cid, err)
+		}
+		if got != key {
+			t.Errorf("cidToKey(keyToCID(%q)) = %q, want %q", key, got, key)
+		}
+	}
+}
+
+func TestKeyToCIDRejectsTruncatedSHA512(t *testing.T) {
+	h, err := HashAlgoSHA512.new()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("announce me"))
+	key := hashToKeyAlgo(HashAlgoSHA512, h) // truncated, the default on-disk form
+
+	if _, err := keyToCID(key); err == nil {
+		t.Errorf("keyToCID(%q) should refuse a truncated sha512 key rather than derive a bogus CID", key)
+	}
+}
+
+func TestKeyToCIDRejectsUnknownPrefix(t *testing.T) {
+	if _, err := keyToCID("md5-deadbeef"); err == nil {
+		t.Error("keyToCID with an unsupported prefix should fail")
+	}
+}
+
+func TestIPFSSourcePutRejectsOversizedBlob(t *testing.T) {
+	h, err := HashAlgoSHA256.new()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Write([]byte("announce me"))
+	key := hashToKeyAlgo(HashAlgoSHA256, h)
+
+	s := &IPFSSource{api: "http://127.0.0.1:0"}
+	oversized := bytes.NewReader(make([]byte, ipfsMaxBlockSize+1))
+
+	if err := s.Put(key, oversized); err == nil {
+		t.Error("Put should refuse a blob bigger than ipfsMaxBlockSize rather than attempt an upload")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/golang.org/x/crypto/openpgp"
+)
+
+// keystoreRootPrefix is the fallback bucket consulted when no
+// prefix-specific key trusts an image; pass it to TrustKey/UntrustKey to
+// trust a key for every image name.
+const keystoreRootPrefix = "@"
+
+// Keystore manages a directory tree of trusted GPG public keys, one
+// sub-directory per ACIdentifier name prefix (e.g. "example.com/app")
+// under prefix.d, plus a root.d fallback bucket for keys trusted
+// regardless of name.
+type Keystore struct {
+	rootPath   string
+	prefixPath string
+}
+
+// NewKeystore returns a Keystore rooted at dir/trustedkeys.
+func NewKeystore(dir string) *Keystore {
+	base := filepath.Join(dir, "trustedkeys")
+	return &Keystore{
+		rootPath:   filepath.Join(base, "root.d"),
+		prefixPath: filepath.Join(base, "prefix.d"),
+	}
+}
+
+// dirForPrefix returns the directory holding keys trusted for prefix.
+func (ks *Keystore) dirForPrefix(prefix string) string {
+	if prefix == keystoreRootPrefix {
+		return ks.rootPath
+	}
+	return filepath.Join(ks.prefixPath, prefix)
+}
+
+// keyDirs returns, most specific first, every directory that may hold a
+// key trusted for an image named name: each path-separated prefix of
+// name under prefix.d (e.g. for "example.com/app/foo":
+// ".../example.com/app/foo", ".../example.com/app", ".../example.com"),
+// and finally root.d.
+func (ks *Keystore) keyDirs(name string) []string {
+	parts := strings.Split(name, "/")
+	dirs := make([]string, 0, len(parts)+1)
+	for i := len(parts); i > 0; i-- {
+		dirs = append(dirs, filepath.Join(ks.prefixPath, filepath.Join(parts[:i]...)))
+	}
+	return append(dirs, ks.rootPath)
+}
+
+// entitiesForPrefix loads every trusted public key that could apply to an
+// image named name, across all of its name prefixes and the root bucket.
+func (ks *Keystore) entitiesForPrefix(name string) (openpgp.EntityList, error) {
+	var all openpgp.EntityList
+	for _, dir := range ks.keyDirs(name) {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				continue
+			}
+			f, err := os.Open(filepath.Join(dir, fi.Name()))
+			if err != nil {
+				return nil, err
+			}
+			el, err := openpgp.ReadKeyRing(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("error reading trusted key %q: %v", fi.Name(), err)
+			}
+			all = append(all, el...)
+		}
+	}
+	return all, nil
+}
+
+// parseArmoredKey reads a single ascii-armored public key from r and
+// returns it along with its hex fingerprint.
+func parseArmoredKey(r io.Reader) (*openpgp.Entity, string, error) {
+	el, err := openpgp.ReadArmoredKeyRing(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading public key: %v", err)
+	}
+	if len(el) != 1 {
+		return nil, "", fmt.Errorf("expected exactly one public key, got %d", len(el))
+	}
+	entity := el[0]
+	return entity, fmt.Sprintf("%x", entity.PrimaryKey.Fingerprint), nil
+}
+
+// storeEntity persists entity under dir, named by fingerprint.
+func storeEntity(dir, fingerprint string, entity *openpgp.Entity) error {
+	if err := os.MkdirAll(dir, defaultPathPerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, fingerprint), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, defaultFilePerm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return entity.Serialize(f)
+}
+
+// fetchArmoredKey reads an armored public key from location, which may be
+// a local file path or an http(s) URL, mirroring how the appc tooling
+// fetches pubkeys discovered alongside an image.
+func fetchArmoredKey(location string) (io.ReadCloser, error) {
+	if u, err := url.Parse(location); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		resp, err := http.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("error fetching key: %v", resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(location)
+}
+
+// TrustKey fetches an armored public GPG key from location (a local file
+// path or an http(s) URL), checks that its fingerprint matches the
+// expected one (trust-on-first-use pinning: the caller is expected to
+// have confirmed fingerprint out of band, e.g. by prompting the user),
+// and adds it to the keystore as trusted for images whose Name starts
+// with prefix. Pass keystoreRootPrefix ("@") to trust it for every image.
+// An empty fingerprint skips the fingerprint check.
+func (s Store) TrustKey(prefix, location, fingerprint string) error {
+	r, err := fetchArmoredKey(location)
+	if err != nil {
+		return fmt.Errorf("error fetching key: %v", err)
+	}
+	defer r.Close()
+
+	entity, gotFingerprint, err := parseArmoredKey(r)
+	if err != nil {
+		return err
+	}
+	want := strings.ToLower(strings.Replace(fingerprint, " ", "", -1))
+	got := strings.ToLower(gotFingerprint)
+	if want != "" && want != got {
+		return fmt.Errorf("fingerprint mismatch: expected %q, key at %q has %q", fingerprint, location, gotFingerprint)
+	}
+
+	if err := storeEntity(s.keystore.dirForPrefix(prefix), got, entity); err != nil {
+		return fmt.Errorf("error storing trusted key: %v", err)
+	}
+	return nil
+}
+
+// UntrustKey removes the key with the given fingerprint from prefix's
+// trusted bucket.
+func (s Store) UntrustKey(prefix, fingerprint string) error {
+	path := filepath.Join(s.keystore.dirForPrefix(prefix), strings.ToLower(fingerprint))
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing trusted key: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coreos/rkt/pkg/lock"
+	"github.com/coreos/rkt/pkg/oci"
+)
+
+const (
+	// ociHashPrefix marks CAS keys derived from an OCI digest rather than
+	// from rkt's own sha512 ACI hashing. Unlike default (sha512) ACI keys
+	// these are never truncated: OCI tooling addresses blobs by their full digest, and
+	// shortening it would make WriteOCI's keys stop matching the
+	// manifests and indexes that reference them.
+	ociHashPrefix = "sha256-"
+
+	ociIndexPath = "index.json"
+)
+
+// OCIImageInfo is the OCI analogue of ACIInfo: metadata recorded for an
+// image imported via WriteOCI, keyed by the CAS key of its config blob.
+type OCIImageInfo struct {
+	BlobKey        string // CAS key of the image config blob
+	MediaType      string
+	ManifestDigest string
+	Platform       string
+	ImportTime     time.Time
+}
+
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// isOCIImage reports whether key belongs to an image imported via
+// WriteOCI, by checking for an OCIImageInfo row rather than sniffing key's
+// prefix: since WithHashAlgo(HashAlgoSHA256) lets WriteACI produce
+// ACI keys with that exact same "sha256-" prefix, the prefix alone can't
+// tell the two apart.
+func (s Store) isOCIImage(key string) (bool, error) {
+	var found bool
+	err := s.db.Do(func(tx *sql.Tx) error {
+		_, ok, err := GetOCIImageInfoWithBlobKey(tx, key)
+		found = ok
+		return err
+	})
+	if err != nil {
+		return false, fmt.Errorf("error checking OCI image info: %v", err)
+	}
+	return found, nil
+}
+
+// WriteOCI takes an OCI image-layout tarball (as produced by e.g. `skopeo
+// copy` or `docker save --format=oci`), and imports every blob it
+// references into the CAS, each keyed by its own sha256 digest. It returns
+// the CAS key of the image config blob, which callers should treat the way
+// WriteACI's returned key is treated: as the handle for the image.
+//
+// Only the first entry of index.json is imported; rkt fetches and runs a
+// single image per pull, and both skopeo and docker only ever produce a
+// layout with one.
+func (s Store) WriteOCI(r io.ReadSeeker) (string, error) {
+	blobs, err := ociReadLayout(r)
+	if err != nil {
+		return "", fmt.Errorf("error reading OCI layout: %v", err)
+	}
+
+	rawIndex, ok := blobs[ociIndexPath]
+	if !ok {
+		return "", fmt.Errorf("OCI layout missing %s", ociIndexPath)
+	}
+	var idx ociIndex
+	if err := json.Unmarshal(rawIndex, &idx); err != nil {
+		return "", fmt.Errorf("error parsing %s: %v", ociIndexPath, err)
+	}
+	if len(idx.Manifests) == 0 {
+		return "", fmt.Errorf("OCI layout index has no manifests")
+	}
+	manifestDesc := idx.Manifests[0]
+
+	rawManifest, err := ociBlobByDigest(blobs, manifestDesc.Digest)
+	if err != nil {
+		return "", fmt.Errorf("error reading OCI manifest: %v", err)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return "", fmt.Errorf("error parsing OCI manifest: %v", err)
+	}
+
+	for _, l := range manifest.Layers {
+		layer, err := ociBlobByDigest(blobs, l.Digest)
+		if err != nil {
+			return "", fmt.Errorf("error reading OCI layer %s: %v", l.Digest, err)
+		}
+		if _, err := s.writeOCIBlob(l.Digest, layer); err != nil {
+			return "", fmt.Errorf("error importing OCI layer %s: %v", l.Digest, err)
+		}
+	}
+
+	rawConfig, err := ociBlobByDigest(blobs, manifest.Config.Digest)
+	if err != nil {
+		return "", fmt.Errorf("error reading OCI config: %v", err)
+	}
+	configKey, err := s.writeOCIBlob(manifest.Config.Digest, rawConfig)
+	if err != nil {
+		return "", fmt.Errorf("error importing OCI config: %v", err)
+	}
+
+	// The manifest itself is kept too, so RenderTreeStore can later
+	// re-derive the ordered layer list for this image without needing the
+	// original tarball again.
+	if _, err := s.writeOCIBlob(manifestDesc.Digest, rawManifest); err != nil {
+		return "", fmt.Errorf("error importing OCI manifest: %v", err)
+	}
+
+	platform := ""
+	if manifestDesc.Platform != nil {
+		platform = manifestDesc.Platform.OS + "/" + manifestDesc.Platform.Architecture
+	}
+
+	if err := s.db.Do(func(tx *sql.Tx) error {
+		info := &OCIImageInfo{
+			BlobKey:        configKey,
+			MediaType:      manifestDesc.MediaType,
+			ManifestDigest: manifestDesc.Digest,
+			Platform:       platform,
+			ImportTime:     time.Now(),
+		}
+		return WriteOCIImageInfo(tx, info)
+	}); err != nil {
+		return "", fmt.Errorf("error writing OCI image info: %v", err)
+	}
+
+	return configKey, nil
+}
+
+// writeOCIBlob imports data into the blob store, keyed by digest (an OCI
+// "sha256:<hex>" digest string) translated into rkt's "sha256-<hex>" CAS
+// key form. It returns the resulting key.
+func (s Store) writeOCIBlob(digest string, data []byte) (string, error) {
+	key, err := ociDigestToKey(digest)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != key[len(ociHashPrefix):] {
+		return "", fmt.Errorf("OCI blob does not match its digest %s", digest)
+	}
+	keyLock, err := lock.ExclusiveKeyLock(s.imageLockDir, key)
+	if err != nil {
+		return "", fmt.Errorf("error locking image: %v", err)
+	}
+	defer keyLock.Close()
+
+	if err := s.stores[blobType].Write(key, data); err != nil {
+		return "", fmt.Errorf("error writing blob: %v", err)
+	}
+	return key, nil
+}
+
+// ociDigestToKey translates an OCI digest string ("sha256:<hex>") into a
+// CAS key ("sha256-<hex>").
+func ociDigestToKey(digest string) (string, error) {
+	const alg = "sha256:"
+	if !strings.HasPrefix(digest, alg) {
+		return "", fmt.Errorf("unsupported OCI digest algorithm: %q", digest)
+	}
+	return ociHashPrefix + digest[len(alg):], nil
+}
+
+// ociBlobPath returns the path, relative to the layout root, at which an
+// OCI digest's blob is stored inside the image-layout tarball.
+func ociBlobPath(digest string) (string, error) {
+	const alg = "sha256:"
+	if !strings.HasPrefix(digest, alg) {
+		return "", fmt.Errorf("unsupported OCI digest algorithm: %q", digest)
+	}
+	return "blobs/sha256/" + digest[len(alg):], nil
+}
+
+func ociBlobByDigest(blobs map[string][]byte, digest string) ([]byte, error) {
+	p, err := ociBlobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := blobs[p]
+	if !ok {
+		return nil, fmt.Errorf("OCI layout missing blob %s", digest)
+	}
+	return b, nil
+}
+
+// renderOCITreeStore extracts, in dependency order, the layers of the OCI
+// image keyed by configKey into rootfs, applying whiteout semantics across
+// layer boundaries.
+func (s Store) renderOCITreeStore(configKey, rootfs string) error {
+	var info *OCIImageInfo
+	found := false
+	err := s.db.Do(func(tx *sql.Tx) error {
+		var err error
+		info, found, err = GetOCIImageInfoWithBlobKey(tx, configKey)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error getting OCI image info: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("no OCI image found for key: %s", configKey)
+	}
+
+	manifestKey, err := ociDigestToKey(info.ManifestDigest)
+	if err != nil {
+		return err
+	}
+	rawManifest, err := s.stores[blobType].Read(manifestKey)
+	if err != nil {
+		return fmt.Errorf("error reading OCI manifest: %v", err)
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return fmt.Errorf("error parsing OCI manifest: %v", err)
+	}
+
+	layerKeys := make([]string, len(manifest.Layers))
+	for i, l := range manifest.Layers {
+		k, err := ociDigestToKey(l.Digest)
+		if err != nil {
+			return err
+		}
+		layerKeys[i] = k
+	}
+
+	if err := os.MkdirAll(rootfs, defaultPathPerm); err != nil {
+		return err
+	}
+	return oci.RenderLayers(s, layerKeys, rootfs)
+}
+
+// ociReadLayout reads every regular file out of an OCI image-layout
+// tarball into memory, keyed by its path relative to the layout root.
+func ociReadLayout(r io.ReadSeeker) (map[string][]byte, error) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(r)
+	blobs := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		blobs[strings.TrimPrefix(hdr.Name, "./")] = data
+	}
+	return blobs, nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// ociImageInfoCreateStmt creates the table backing OCIImageInfo, the OCI
+// analogue of the aciinfo table. It's appended to dbCreateStmts the same
+// way any other schema addition is, so a store created before WriteOCI
+// existed picks it up via the regular migration path in NewStore.
+const ociImageInfoCreateStmt = `CREATE TABLE ociimageinfo (
+	blobkey string primary key,
+	mediatype string,
+	manifestdigest string,
+	platform string,
+	importtime time
+)`
+
+func init() {
+	dbCreateStmts = append(dbCreateStmts, ociImageInfoCreateStmt)
+}
+
+// WriteOCIImageInfo inserts or replaces info's row, keyed by its BlobKey.
+func WriteOCIImageInfo(tx *sql.Tx, info *OCIImageInfo) error {
+	_, err := tx.Exec("INSERT OR REPLACE INTO ociimageinfo (blobkey, mediatype, manifestdigest, platform, importtime) values ($1, $2, $3, $4, $5)",
+		info.BlobKey, info.MediaType, info.ManifestDigest, info.Platform, info.ImportTime)
+	if err != nil {
+		return fmt.Errorf("error writing oci image info: %v", err)
+	}
+	return nil
+}
+
+// GetOCIImageInfoWithBlobKey returns the OCIImageInfo row for key, if any.
+func GetOCIImageInfoWithBlobKey(tx *sql.Tx, key string) (*OCIImageInfo, bool, error) {
+	rows, err := tx.Query("SELECT blobkey, mediatype, manifestdigest, platform, importtime FROM ociimageinfo WHERE blobkey == $1", key)
+	if err != nil {
+		return nil, false, fmt.Errorf("error retrieving oci image info: %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+	info := &OCIImageInfo{}
+	if err := rows.Scan(&info.BlobKey, &info.MediaType, &info.ManifestDigest, &info.Platform, &info.ImportTime); err != nil {
+		return nil, false, fmt.Errorf("error retrieving oci image info: %v", err)
+	}
+	return info, true, nil
+}
+
+// GetAllOCIImageInfos returns every imported OCI image's info, e.g. for GC
+// to determine which blobs and trees are still reachable.
+func GetAllOCIImageInfos(tx *sql.Tx) ([]*OCIImageInfo, error) {
+	rows, err := tx.Query("SELECT blobkey, mediatype, manifestdigest, platform, importtime FROM ociimageinfo")
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving oci image infos: %v", err)
+	}
+	defer rows.Close()
+
+	var infos []*OCIImageInfo
+	for rows.Next() {
+		info := &OCIImageInfo{}
+		if err := rows.Scan(&info.BlobKey, &info.MediaType, &info.ManifestDigest, &info.Platform, &info.ImportTime); err != nil {
+			return nil, fmt.Errorf("error retrieving oci image infos: %v", err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, rows.Err()
+}
@@ -0,0 +1,256 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/coreos/rkt/pkg/lock"
+	ptar "github.com/coreos/rkt/pkg/tar"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/pkg/acirenderer"
+)
+
+const layerHashFile = ".rkt-layer-hash"
+
+// treeStoreLayersDirName is the shared-layer cache subdirectory under the
+// tree store root that layerDir extracts into. It's a plain sibling of the
+// per-key rendered-tree directories gcOrphanTrees otherwise sweeps, so GC
+// must special-case it rather than treat it as an ordinary (and, since
+// nothing ever names an ACI/OCI key "layers", always orphaned) entry.
+const treeStoreLayersDirName = "layers"
+
+// MountTreeStore is the overlay-backed alternative to
+// RenderTreeStore/GetTreeStoreRootFS: it extracts each ACI in key's
+// dependency chain exactly once into its own shared layer directory under
+// tree/layers, then mounts their rootfs directories together, key's own
+// layer uppermost with its dependencies below it, as a private overlayfs
+// rootfs with its own upperdir/workdir. Two images that
+// share a dependency extract and store that dependency's files only once.
+//
+// Callers must invoke the returned unmount func when done with the mount.
+// On a kernel or platform without overlayfs support (or without
+// CAP_SYS_ADMIN), it falls back to the existing fully materialized
+// rendering: mountPath is GetTreeStoreRootFS's path directly and unmount
+// is a no-op.
+func (s Store) MountTreeStore(key string) (string, func() error, error) {
+	if !overlayAvailable() {
+		if err := s.RenderTreeStore(key, false); err != nil {
+			return "", nil, err
+		}
+		return s.GetTreeStoreRootFS(key), func() error { return nil }, nil
+	}
+
+	lowerdirs, err := s.renderLayers(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmpDir, err := s.TmpDir()
+	if err != nil {
+		return "", nil, err
+	}
+	instanceDir, err := ioutil.TempDir(tmpDir, "overlay-"+filepath.Base(key))
+	if err != nil {
+		return "", nil, err
+	}
+	upperdir := filepath.Join(instanceDir, "upper")
+	workdir := filepath.Join(instanceDir, "work")
+	rootfs := filepath.Join(instanceDir, "rootfs")
+	for _, d := range []string{upperdir, workdir, rootfs} {
+		if err := os.MkdirAll(d, defaultPathPerm); err != nil {
+			os.RemoveAll(instanceDir)
+			return "", nil, err
+		}
+	}
+
+	if err := mountOverlay(lowerdirs, upperdir, workdir, rootfs); err != nil {
+		os.RemoveAll(instanceDir)
+		return "", nil, fmt.Errorf("error mounting overlay: %v", err)
+	}
+
+	unmount := func() error {
+		if err := unmountOverlay(rootfs); err != nil {
+			return fmt.Errorf("error unmounting overlay: %v", err)
+		}
+		return os.RemoveAll(instanceDir)
+	}
+	return rootfs, unmount, nil
+}
+
+// renderLayers extracts, exactly once each, the layer directories for
+// key's full dependency chain and returns the rootfs directory of each, in
+// acirenderer's dependency-list order: key's own image first, then its
+// dependencies (the order overlayfs's lowerdir expects: earlier entries
+// win).
+func (s Store) renderLayers(key string) ([]string, error) {
+	deps, err := acirenderer.CreateDepListFromImageID(key, s)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving dependencies: %v", err)
+	}
+	lowerdirs := make([]string, len(deps))
+	for i, d := range deps {
+		dir, err := s.renderLayer(d.Key)
+		if err != nil {
+			return nil, err
+		}
+		lowerdirs[i] = filepath.Join(dir, "rootfs")
+	}
+	return lowerdirs, nil
+}
+
+// layerDir returns the shared, idempotently-rendered directory an ACI's
+// own files are extracted into.
+func (s Store) layerDir(key string) string {
+	return filepath.Join(s.treestore.path, treeStoreLayersDirName, key)
+}
+
+// renderLayer idempotently extracts a single ACI's own files into its
+// shared layer directory, protected by a dedicated per-key lock so two
+// images that both depend on it only ever extract it once.
+func (s Store) renderLayer(key string) (string, error) {
+	dir := s.layerDir(key)
+
+	layerLock, err := lock.ExclusiveKeyLock(s.treeStoreLockDir, "layer-"+key)
+	if err != nil {
+		return "", fmt.Errorf("error locking layer: %v", err)
+	}
+	defer layerLock.Close()
+
+	if _, err := os.Stat(filepath.Join(dir, layerHashFile)); err == nil {
+		return dir, nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, defaultPathPerm); err != nil {
+		return "", err
+	}
+
+	rs, err := s.ReadStream(key)
+	if err != nil {
+		return "", err
+	}
+	if err := ptar.ExtractTar(rs, dir, false, nil, nil); err != nil {
+		rs.Close()
+		return "", fmt.Errorf("error extracting layer %s: %v", key, err)
+	}
+	rs.Close()
+
+	hash, err := hashDir(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, layerHashFile), []byte(hash), defaultFilePerm); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkLayers verifies, independently, the stored hash of every layer in
+// key's dependency chain against its current on-disk content, so a single
+// corrupted shared layer is reported (and only invalidates images that
+// reference that layer) instead of failing a whole-tree comparison.
+func (s Store) checkLayers(key string) error {
+	deps, err := acirenderer.CreateDepListFromImageID(key, s)
+	if err != nil {
+		return fmt.Errorf("error resolving dependencies: %v", err)
+	}
+	for _, d := range deps {
+		dir := s.layerDir(d.Key)
+		wantBytes, err := ioutil.ReadFile(filepath.Join(dir, layerHashFile))
+		if err != nil {
+			return fmt.Errorf("layer %s not rendered: %v", d.Key, err)
+		}
+		got, err := hashDir(dir)
+		if err != nil {
+			return fmt.Errorf("error hashing layer %s: %v", d.Key, err)
+		}
+		if got != string(wantBytes) {
+			return fmt.Errorf("layer %s is corrupted: expected hash %s, got %s", d.Key, wantBytes, got)
+		}
+	}
+	return nil
+}
+
+// hasRenderedLayers reports whether key's own layer has already been
+// extracted, as a signal that it (and its dependencies) should be
+// verified per-layer rather than via the legacy whole-tree check.
+func (s Store) hasRenderedLayers(key string) bool {
+	_, err := os.Stat(filepath.Join(s.layerDir(key), layerHashFile))
+	return err == nil
+}
+
+// hashDir computes a deterministic hash over every entry's path and
+// content under dir, skipping layerHashFile itself. A symlink entry (real
+// layers are full of them, routinely dangling or pointing outside dir,
+// e.g. "/bin -> usr/bin") is hashed by its link text, never followed: an
+// open of a dangling link would simply fail, and an open of one that
+// happens to resolve against the host filesystem would fold unrelated
+// host content into the hash instead of the layer's own.
+func hashDir(dir string) (string, error) {
+	var paths []string
+	modes := make(map[string]os.FileMode)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || fi.Name() == layerHashFile {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+		modes[rel] = fi.Mode()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, rel := range paths {
+		io.WriteString(h, rel)
+		path := filepath.Join(dir, rel)
+		if modes[rel]&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return "", err
+			}
+			io.WriteString(h, target)
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
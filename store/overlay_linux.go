@@ -0,0 +1,55 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux
+
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// overlayAvailable reports whether this process can mount overlayfs: the
+// running kernel needs to support it, and the process needs
+// CAP_SYS_ADMIN, which in rkt's deployment model means running as root.
+func overlayAvailable() bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if strings.TrimSpace(strings.TrimPrefix(sc.Text(), "nodev")) == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+func mountOverlay(lowerdirs []string, upperdir, workdir, target string) error {
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", strings.Join(lowerdirs, ":"), upperdir, workdir)
+	return syscall.Mount("overlay", target, "overlay", 0, opts)
+}
+
+func unmountOverlay(target string) error {
+	return syscall.Unmount(target, 0)
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeDirFixture(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "rkt-hashdir-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), defaultPathPerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), defaultFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestHashDirDeterministic(t *testing.T) {
+	dirA := writeDirFixture(t, map[string]string{
+		"foo.txt":     "hello",
+		"sub/bar.txt": "world",
+	})
+	defer os.RemoveAll(dirA)
+	dirB := writeDirFixture(t, map[string]string{
+		"sub/bar.txt": "world",
+		"foo.txt":     "hello",
+	})
+	defer os.RemoveAll(dirB)
+
+	hashA, err := hashDir(dirA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashB, err := hashDir(dirB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashA != hashB {
+		t.Errorf("hashDir(dirA) = %q, hashDir(dirB) = %q; want equal for identical content", hashA, hashB)
+	}
+}
+
+func TestHashDirChangesWithContent(t *testing.T) {
+	dir := writeDirFixture(t, map[string]string{"foo.txt": "hello"})
+	defer os.RemoveAll(dir)
+
+	before, err := hashDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("goodbye"), defaultFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	after, err := hashDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before == after {
+		t.Error("hashDir should change when a file's content changes")
+	}
+}
+
+func TestHashDirIgnoresLayerHashFile(t *testing.T) {
+	dir := writeDirFixture(t, map[string]string{"foo.txt": "hello"})
+	defer os.RemoveAll(dir)
+
+	before, err := hashDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, layerHashFile), []byte(before), defaultFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	after, err := hashDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before != after {
+		t.Errorf("hashDir should ignore %s, got %q want %q", layerHashFile, after, before)
+	}
+}
+
+func TestHashDirHandlesDanglingSymlink(t *testing.T) {
+	dir := writeDirFixture(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink("nonexistent-target", filepath.Join(dir, "broken-link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := hashDir(dir); err != nil {
+		t.Fatalf("hashDir should hash a dangling symlink by its link text, not follow it: %v", err)
+	}
+}
+
+func TestHashDirChangesWithSymlinkTarget(t *testing.T) {
+	dir := writeDirFixture(t, map[string]string{})
+	defer os.RemoveAll(dir)
+
+	if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	before, err := hashDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	after, err := hashDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if before == after {
+		t.Error("hashDir should change when a symlink's target changes")
+	}
+}
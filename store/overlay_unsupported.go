@@ -0,0 +1,29 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux
+
+package store
+
+import "errors"
+
+func overlayAvailable() bool { return false }
+
+func mountOverlay(lowerdirs []string, upperdir, workdir, target string) error {
+	return errors.New("overlayfs is only supported on linux")
+}
+
+func unmountOverlay(target string) error {
+	return errors.New("overlayfs is only supported on linux")
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/coreos/rkt/pkg/lock"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/aci"
+	"github.com/coreos/rkt/Godeps/_workspace/src/golang.org/x/crypto/openpgp"
+	pgperrors "github.com/coreos/rkt/Godeps/_workspace/src/golang.org/x/crypto/openpgp/errors"
+)
+
+// WriteACIOption customizes a single WriteACI or WriteACIWithSignature call.
+type WriteACIOption func(*writeACIConfig)
+
+type writeACIConfig struct {
+	algo HashAlgo
+}
+
+// WithHashAlgo selects the digest algorithm used to compute the resulting
+// CAS key. The default, used when no WriteACIOption is given, is
+// HashAlgoSHA512, for backward compatibility with existing stores.
+func WithHashAlgo(algo HashAlgo) WriteACIOption {
+	return func(c *writeACIConfig) {
+		c.algo = algo
+	}
+}
+
+// WriteACIWithSignature is WriteACI plus signature verification: it
+// resolves the keys trusted for the manifest's Name prefix from the
+// store's Keystore and verifies sig as a detached signature over the
+// uncompressed ACI stream before importing. If sig is nil, or no key is
+// trusted for the image, or sig was made by a key not trusted for it, the
+// import is refused unless AllowUnsigned was set on NewStore. On success, the fingerprint of the verifying key (if
+// any) is persisted into the resulting ACIInfo.
+func (s Store) WriteACIWithSignature(r io.ReadSeeker, sig io.Reader, latest bool, opts ...WriteACIOption) (string, error) {
+	cfg := writeACIConfig{algo: HashAlgoSHA512}
+	for _, o := range opts {
+		o(&cfg)
+	}
+
+	dr, err := aci.NewCompressedReader(r)
+	if err != nil {
+		return "", fmt.Errorf("error decompressing image: %v", err)
+	}
+
+	// Write the decompressed image (tar) to a temporary file on disk, and
+	// tee so we can generate the hash
+	h, err := cfg.algo.new()
+	if err != nil {
+		return "", err
+	}
+	tr := io.TeeReader(dr, h)
+	fh, err := s.TmpFile()
+	if err != nil {
+		return "", fmt.Errorf("error creating image: %v", err)
+	}
+	if _, err := io.Copy(fh, tr); err != nil {
+		fh.Close()
+		return "", fmt.Errorf("error copying image: %v", err)
+	}
+	im, err := aci.ManifestFromImage(fh)
+	if err != nil {
+		fh.Close()
+		return "", fmt.Errorf("error extracting image manifest: %v", err)
+	}
+
+	fingerprint, err := s.verifySignature(fh, sig, im.Name.String())
+	if err != nil {
+		fh.Close()
+		return "", err
+	}
+
+	if err := fh.Close(); err != nil {
+		return "", fmt.Errorf("error closing image: %v", err)
+	}
+
+	// Import the uncompressed image into the store at the real key
+	key := s.HashToKeyAlgo(cfg.algo, h)
+	keyLock, err := lock.ExclusiveKeyLock(s.imageLockDir, key)
+	if err != nil {
+		return "", fmt.Errorf("error locking image: %v", err)
+	}
+	defer keyLock.Close()
+
+	if err = s.stores[blobType].Import(fh.Name(), key, true); err != nil {
+		return "", fmt.Errorf("error importing image: %v", err)
+	}
+
+	// Save the imagemanifest using the same key used for the image
+	imj, err := json.Marshal(im)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling image manifest: %v", err)
+	}
+	if err = s.stores[imageManifestType].Write(key, imj); err != nil {
+		return "", fmt.Errorf("error importing image manifest: %v", err)
+	}
+
+	// Save aciinfo
+	if err = s.db.Do(func(tx *sql.Tx) error {
+		aciinfo := &ACIInfo{
+			BlobKey:     key,
+			AppName:     im.Name.String(),
+			ImportTime:  time.Now(),
+			Latest:      latest,
+			Fingerprint: fingerprint,
+			Algo:        byte(cfg.algo),
+		}
+		return WriteACIInfo(tx, aciinfo)
+	}); err != nil {
+		return "", fmt.Errorf("error writing ACI Info: %v", err)
+	}
+
+	// The treestore for this ACI is not written here as ACIs downloaded as
+	// dependencies of another ACI will be exploded also if never directly used.
+	// Users of treestore should call s.RenderTreeStore before using it.
+
+	s.announceToSources(key)
+
+	return key, nil
+}
+
+// verifySignature checks sig as a detached signature over the decompressed
+// ACI stream already written to fh, using keys trusted for appName. It
+// returns the verifying key's fingerprint, which is empty when the image
+// was accepted unsigned (only possible with AllowUnsigned).
+func (s Store) verifySignature(fh *os.File, sig io.Reader, appName string) (string, error) {
+	if sig == nil {
+		if s.allowUnsigned {
+			return "", nil
+		}
+		return "", fmt.Errorf("image %q is unsigned; refusing to import (use AllowUnsigned to override)", appName)
+	}
+
+	entities, err := s.keystore.entitiesForPrefix(appName)
+	if err != nil {
+		return "", fmt.Errorf("error loading trusted keys: %v", err)
+	}
+	if len(entities) == 0 {
+		if s.allowUnsigned {
+			return "", nil
+		}
+		return "", fmt.Errorf("no trusted keys for %q; refusing to import untrusted image", appName)
+	}
+
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("error seeking image: %v", err)
+	}
+	signer, err := openpgp.CheckDetachedSignature(entities, fh, sig)
+	if err == pgperrors.ErrUnknownIssuer && s.allowUnsigned {
+		// signed, but by a key not trusted for appName
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("signature verification failed: %v", err)
+	}
+	return fmt.Sprintf("%x", signer.PrimaryKey.Fingerprint), nil
+}
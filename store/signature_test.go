@@ -0,0 +1,160 @@
+// Copyright 2015 The rkt Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/coreos/rkt/Godeps/_workspace/src/golang.org/x/crypto/openpgp"
+)
+
+const testAppName = "example.com/app"
+
+func writeTempContent(t *testing.T, content string) *os.File {
+	fh, err := ioutil.TempFile("", "rkt-signature-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fh.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return fh
+}
+
+func detachSign(t *testing.T, entity *openpgp.Entity, content string) []byte {
+	var buf bytes.Buffer
+	if err := openpgp.DetachSign(&buf, entity, bytes.NewReader([]byte(content)), nil); err != nil {
+		t.Fatalf("DetachSign: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerifySignatureTrustedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-keystore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entity, err := openpgp.NewEntity("rkt test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := fmt.Sprintf("%x", entity.PrimaryKey.Fingerprint)
+
+	ks := NewKeystore(dir)
+	if err := storeEntity(ks.dirForPrefix(testAppName), fingerprint, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Store{keystore: ks}
+	content := "the uncompressed aci stream"
+	sig := detachSign(t, entity, content)
+
+	fh := writeTempContent(t, content)
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	got, err := s.verifySignature(fh, bytes.NewReader(sig), testAppName)
+	if err != nil {
+		t.Fatalf("verifySignature: %v", err)
+	}
+	if got != fingerprint {
+		t.Errorf("verifySignature fingerprint = %q, want %q", got, fingerprint)
+	}
+}
+
+func TestVerifySignatureWrongContentFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-keystore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entity, err := openpgp.NewEntity("rkt test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprint := fmt.Sprintf("%x", entity.PrimaryKey.Fingerprint)
+
+	ks := NewKeystore(dir)
+	if err := storeEntity(ks.dirForPrefix(testAppName), fingerprint, entity); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Store{keystore: ks}
+	sig := detachSign(t, entity, "the real content")
+
+	fh := writeTempContent(t, "tampered content")
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := s.verifySignature(fh, bytes.NewReader(sig), testAppName); err == nil {
+		t.Error("verifySignature should reject a signature over different content")
+	}
+}
+
+func TestVerifySignatureUnsignedRefusedByDefault(t *testing.T) {
+	s := Store{keystore: NewKeystore("")}
+	fh := writeTempContent(t, "some content")
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := s.verifySignature(fh, nil, testAppName); err == nil {
+		t.Error("verifySignature should refuse a nil signature unless AllowUnsigned was set")
+	}
+}
+
+func TestVerifySignatureUnsignedAllowed(t *testing.T) {
+	s := Store{keystore: NewKeystore(""), allowUnsigned: true}
+	fh := writeTempContent(t, "some content")
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	fingerprint, err := s.verifySignature(fh, nil, testAppName)
+	if err != nil {
+		t.Fatalf("verifySignature: %v", err)
+	}
+	if fingerprint != "" {
+		t.Errorf("verifySignature fingerprint = %q, want empty for an unsigned import", fingerprint)
+	}
+}
+
+func TestVerifySignatureNoTrustedKeyRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rkt-keystore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entity, err := openpgp.NewEntity("rkt test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := detachSign(t, entity, "some content")
+
+	s := Store{keystore: NewKeystore(dir)} // nothing trusted in this keystore
+	fh := writeTempContent(t, "some content")
+	defer os.Remove(fh.Name())
+	defer fh.Close()
+
+	if _, err := s.verifySignature(fh, bytes.NewReader(sig), testAppName); err == nil {
+		t.Error("verifySignature should refuse an image with no trusted key for its prefix")
+	}
+}
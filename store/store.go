@@ -17,7 +17,6 @@ package store
 import (
 	"crypto/sha512"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -25,19 +24,14 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
-	"time"
 
 	"github.com/coreos/rkt/pkg/lock"
 
-	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/aci"
 	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema"
 	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/appc/spec/schema/types"
 
-	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/jbenet/go-multihash"
 	"github.com/coreos/rkt/Godeps/_workspace/src/github.com/peterbourgon/diskv"
 )
 
@@ -54,7 +48,6 @@ const (
 	lenHash    = sha512.Size       // raw byte size
 	lenHashKey = (lenHash / 2) * 2 // half length, in hex characters
 	lenKey     = len(hashPrefix) + lenHashKey
-	minlenKey  = len(hashPrefix) + 2 // at least sha512-aa
 
 	// how many backups to keep when migrating to new db version
 	backupsNumber = 5
@@ -101,14 +94,48 @@ type Store struct {
 	storeLock        *lock.FileLock
 	imageLockDir     string
 	treeStoreLockDir string
+	// sources are the remote ContentSources consulted, in order, on a
+	// local blob cache miss, and announced to after a successful WriteACI.
+	sources []ContentSource
+	// keystore holds the trusted GPG public keys consulted by
+	// WriteACIWithSignature.
+	keystore *Keystore
+	// allowUnsigned lets WriteACIWithSignature (and thus WriteACI, which
+	// calls it with a nil signature) import images that are unsigned or
+	// signed by a key no prefix trusts.
+	allowUnsigned bool
 }
 
-func NewStore(baseDir string) (*Store, error) {
+// StoreOption customizes a Store at construction time.
+type StoreOption func(*Store)
+
+// WithContentSources overrides the default set of remote ContentSources
+// (normally a single localhost IPFSSource) with srcs.
+func WithContentSources(srcs ...ContentSource) StoreOption {
+	return func(s *Store) {
+		s.sources = srcs
+	}
+}
+
+// AllowUnsigned lets WriteACIWithSignature import unsigned or untrusted
+// images instead of refusing them.
+func AllowUnsigned() StoreOption {
+	return func(s *Store) {
+		s.allowUnsigned = true
+	}
+}
+
+func NewStore(baseDir string, opts ...StoreOption) (*Store, error) {
 	storeDir := filepath.Join(baseDir, "cas")
 
 	s := &Store{
-		dir:    storeDir,
-		stores: make([]*diskv.Diskv, len(diskvStores)),
+		dir:      storeDir,
+		stores:   make([]*diskv.Diskv, len(diskvStores)),
+		sources:  []ContentSource{NewIPFSSource("")},
+		keystore: NewKeystore(storeDir),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	s.imageLockDir = filepath.Join(storeDir, "imagelocks")
@@ -192,7 +219,14 @@ func NewStore(baseDir string) (*Store, error) {
 			return nil, err
 		}
 		fn := func(tx *sql.Tx) error {
-			return migrate(tx, dbVersion)
+			if err := migrate(tx, dbVersion); err != nil {
+				return err
+			}
+			// Every pre-existing ACIInfo row predates HashAlgo support and
+			// was necessarily written by the old, sha512-only WriteACI, so
+			// backfilling its new algo column with HashAlgoSHA512 (zero
+			// value) is unconditionally correct, not just a best guess.
+			return migrateACIInfoAlgoColumn(tx)
 		}
 		if err = db.Do(fn); err != nil {
 			return nil, err
@@ -231,23 +265,38 @@ func (s Store) TmpDir() (string, error) {
 // ResolveKey resolves a partial key (of format `sha512-0c45e8c0ab2`) to a full
 // key by considering the key a prefix and using the store for resolution.
 // If the key is longer than the full key length, it is first truncated.
+//
+// The algorithm is identified from key's own prefix (see HashAlgo), so a
+// "sha256-ab…" partial key is only ever resolved against sha256 keys, never
+// colliding with a "sha512-ab…" one that happens to share the same hex
+// digits.
 func (s Store) ResolveKey(key string) (string, error) {
 	log.Printf("RESOLVEKEY %q", key)
-	if !strings.HasPrefix(key, hashPrefix) {
-		return "", fmt.Errorf("wrong key prefix")
+	algo, err := algoForKey(key)
+	if err != nil {
+		return "", err
 	}
-	if len(key) < minlenKey {
+	full := algo.fullKeyLen()
+	if len(key) < len(algo.prefix())+2 {
 		return "", fmt.Errorf("key too short")
 	}
-	if len(key) > lenKey {
-		key = key[:lenKey]
+	if len(key) > full {
+		key = key[:full]
 	}
-	if len(key) == lenKey {
+	if len(key) == full {
 		return key, nil
 	}
 
+	// Partial keys are only resolved against ACIInfo rows, which covers
+	// every algorithm WriteACI can produce. OCI-imported blobs live in a
+	// separate table and aren't addressable by prefix yet.
+	//
+	// TODO(rkt#chunk0-2): partial-key lookup for OCI-imported blobs needs
+	// an OCIImageInfo-backed prefix query analogous to
+	// GetACIInfosWithKeyPrefix; until then only full OCI keys resolve,
+	// which covers the digests found in index.json/manifests.
 	aciInfos := []*ACIInfo{}
-	err := s.db.Do(func(tx *sql.Tx) error {
+	err = s.db.Do(func(tx *sql.Tx) error {
 		var err error
 		aciInfos, err = GetACIInfosWithKeyPrefix(tx, key)
 		return err
@@ -281,9 +330,12 @@ func (s Store) ReadStream(key string) (io.ReadCloser, error) {
 	r, err := s.stores[blobType].ReadStream(key, false)
 	if err != nil && os.IsNotExist(err) {
 		log.Printf("BLOB NOPE %v", err)
-		// try secondary source
-		if r2, err2 := s.readStreamFromIPFS(key); err2 == nil {
-			r, err = r2, err2
+		// try the registered remote sources in order
+		for _, src := range s.sources {
+			if r2, err2 := src.Get(key); err2 == nil {
+				r, err = r2, nil
+				break
+			}
 		}
 	}
 	if err != nil {
@@ -292,118 +344,40 @@ func (s Store) ReadStream(key string) (io.ReadCloser, error) {
 	return r, nil
 }
 
-func (s *Store) readStreamFromIPFS(key string) (io.ReadCloser, error) {
-	const prefix = "sha512-"
-	if !strings.HasPrefix(key, prefix) {
-		return nil, errors.New("only sha512 implemented in IPFS reader")
-	}
-	h, err := hex.DecodeString(key[len(prefix):])
-	if err != nil {
-		return nil, err
-	}
-	log.Printf("decoded %x", h)
-	mhbuf, err := multihash.Encode(h[:32], multihash.SHA2_512)
-	if err != nil {
-		return nil, err
-	}
-	log.Printf("multihash %x", mhbuf)
-	mh, err := multihash.Cast(mhbuf)
-	if err != nil {
-		return nil, err
-	}
-	// b58 will never require quoting
-	log.Printf("b58 %v", mh.B58String())
-	u := "http://localhost:5001/api/v0/block/get?arg=" + mh.B58String()
-	log.Printf("GET %v", u)
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return nil, err
-	}
-	// IPFS likes to slam the socket shut, triggering
-	// https://github.com/golang/go/issues/8946
-	req.Close = true
-	resp, err := http.DefaultClient.Do(req)
-	log.Printf("GET GOT %v", err)
-	if err != nil {
-		return nil, err
-	}
-	log.Printf("GET STATUS %v", resp.Status)
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("http error: %v", resp.Status)
-	}
-	log.Printf("YAY")
-	return resp.Body, nil
-}
-
 // WriteACI takes an ACI encapsulated in an io.Reader, decompresses it if
 // necessary, and then stores it in the store under a key based on the image ID
 // (i.e. the hash of the uncompressed ACI)
 // latest defines if the aci has to be marked as the latest. For example an ACI
 // discovered without asking for a specific version (latest pattern).
-func (s Store) WriteACI(r io.ReadSeeker, latest bool) (string, error) {
-	dr, err := aci.NewCompressedReader(r)
-	if err != nil {
-		return "", fmt.Errorf("error decompressing image: %v", err)
-	}
-
-	// Write the decompressed image (tar) to a temporary file on disk, and
-	// tee so we can generate the hash
-	h := sha512.New()
-	tr := io.TeeReader(dr, h)
-	fh, err := s.TmpFile()
-	if err != nil {
-		return "", fmt.Errorf("error creating image: %v", err)
-	}
-	if _, err := io.Copy(fh, tr); err != nil {
-		return "", fmt.Errorf("error copying image: %v", err)
-	}
-	im, err := aci.ManifestFromImage(fh)
-	if err != nil {
-		return "", fmt.Errorf("error extracting image manifest: %v", err)
-	}
-	if err := fh.Close(); err != nil {
-		return "", fmt.Errorf("error closing image: %v", err)
-	}
-
-	// Import the uncompressed image into the store at the real key
-	key := s.HashToKey(h)
-	keyLock, err := lock.ExclusiveKeyLock(s.imageLockDir, key)
-	if err != nil {
-		return "", fmt.Errorf("error locking image: %v", err)
-	}
-	defer keyLock.Close()
+// It's equivalent to WriteACIWithSignature with a nil signature; unless the
+// store was created with AllowUnsigned, that now means the import is
+// refused since there's nothing to verify it against. opts is passed
+// through to WriteACIWithSignature, e.g. to select a HashAlgo other than
+// the default sha512.
+func (s Store) WriteACI(r io.ReadSeeker, latest bool, opts ...WriteACIOption) (string, error) {
+	return s.WriteACIWithSignature(r, nil, latest, opts...)
+}
 
-	if err = s.stores[blobType].Import(fh.Name(), key, true); err != nil {
-		return "", fmt.Errorf("error importing image: %v", err)
+// announceToSources publishes the blob for key to any writable
+// ContentSources in a single Put, so the CID (or other content address) a
+// source derives is the same one ReadStream's fallback, via the source's
+// own Get, will later look key up by. Failures are logged but not fatal:
+// the ACI is already safely committed to the local CAS.
+func (s Store) announceToSources(key string) {
+	for _, src := range s.sources {
+		if err := announceBlob(s.stores[blobType], key, src); err != nil {
+			log.Printf("warning: error announcing %s: %v", key, err)
+		}
 	}
+}
 
-	// Save the imagemanifest using the same key used for the image
-	imj, err := json.Marshal(im)
+func announceBlob(blobs *diskv.Diskv, key string, src ContentSource) error {
+	f, err := blobs.ReadStream(key, false)
 	if err != nil {
-		return "", fmt.Errorf("error marshalling image manifest: %v", err)
-	}
-	if err = s.stores[imageManifestType].Write(key, imj); err != nil {
-		return "", fmt.Errorf("error importing image manifest: %v", err)
-	}
-
-	// Save aciinfo
-	if err = s.db.Do(func(tx *sql.Tx) error {
-		aciinfo := &ACIInfo{
-			BlobKey:    key,
-			AppName:    im.Name.String(),
-			ImportTime: time.Now(),
-			Latest:     latest,
-		}
-		return WriteACIInfo(tx, aciinfo)
-	}); err != nil {
-		return "", fmt.Errorf("error writing ACI Info: %v", err)
+		return err
 	}
-
-	// The treestore for this ACI is not written here as ACIs downloaded as
-	// dependencies of another ACI will be exploded also if never directly used.
-	// Users of treestore should call s.RenderTreeStore before using it.
-
-	return key, nil
+	defer f.Close()
+	return src.Put(key, f)
 }
 
 // RemoveACI removes the ACI with the given key. It firstly removes the aci
@@ -487,6 +461,16 @@ func (s Store) RenderTreeStore(key string, rebuild bool) error {
 	if err := s.treestore.Remove(key); err != nil {
 		return err
 	}
+	isOCI, err := s.isOCIImage(key)
+	if err != nil {
+		return err
+	}
+	if isOCI {
+		if err := s.renderOCITreeStore(key, s.treestore.GetRootFS(key)); err != nil {
+			return fmt.Errorf("TREE STORE WRITE ERROR: %v", err)
+		}
+		return nil
+	}
 	if err := s.treestore.Write(key, &s); err != nil {
 		return fmt.Errorf("TREE STORE WRITE ERROR: %v", err)
 	}
@@ -501,6 +485,13 @@ func (s Store) CheckTreeStore(key string) error {
 	}
 	defer treeStoreKeyLock.Close()
 
+	// If key was rendered via MountTreeStore's overlay layers rather than
+	// the classic full copy, verify each layer independently: a
+	// corrupted shared layer should only invalidate the images that
+	// reference it, not fail every tree built from it.
+	if s.hasRenderedLayers(key) {
+		return s.checkLayers(key)
+	}
 	return s.treestore.Check(key)
 }
 
@@ -574,7 +565,7 @@ func (s Store) GetImageManifest(key string) (*schema.ImageManifest, error) {
 	// if err != nil && os.IsNotExist(err) {
 	// 	log.Printf("BLOB NOPE %v", err)
 	// 	// try secondary source
-	// 	if imj2, err2 := s.readFromIPFS(key); err2 == nil {
+	// 	if imj2, err2 := s.readFromSources(key); err2 == nil {
 	// 		imj, err = imj2, err2
 	// 	}
 	// }
@@ -589,13 +580,18 @@ func (s Store) GetImageManifest(key string) (*schema.ImageManifest, error) {
 	return im, nil
 }
 
-func (s *Store) readFromIPFS(key string) ([]byte, error) {
-	r, err := s.readStreamFromIPFS(key)
-	if err != nil {
-		return nil, err
+// readFromSources reads the blob for key from the first registered
+// ContentSource that has it.
+func (s *Store) readFromSources(key string) ([]byte, error) {
+	for _, src := range s.sources {
+		r, err := src.Get(key)
+		if err != nil {
+			continue
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
 	}
-	defer r.Close()
-	return ioutil.ReadAll(r)
+	return nil, ErrKeyNotFound
 }
 
 // GetACI retrieves the ACI that best matches the provided app name and labels.
@@ -701,22 +697,16 @@ func (s Store) Dump(hex bool) {
 	}
 }
 
-// HashToKey takes a hash.Hash (which currently _MUST_ represent a full SHA512),
-// calculates its sum, and returns a string which should be used as the key to
-// store the data matching the hash.
+// HashToKey takes a hash.Hash, calculates its sum, and returns a string
+// which should be used as the key to store the data matching the hash. It
+// assumes h was created with HashAlgoSHA512, for backward compatibility
+// with existing callers; see HashToKeyAlgo for other algorithms.
 func (s Store) HashToKey(h hash.Hash) string {
-	return hashToKey(h)
-}
-
-func hashToKey(h hash.Hash) string {
-	s := h.Sum(nil)
-	return keyToString(s)
+	return s.HashToKeyAlgo(HashAlgoSHA512, h)
 }
 
-// keyToString takes a key and returns a shortened and prefixed hexadecimal string version
-func keyToString(k []byte) string {
-	if len(k) != lenHash {
-		panic(fmt.Sprintf("bad hash passed to hashToKey: %x", k))
-	}
-	return fmt.Sprintf("%s%x", hashPrefix, k)[0:lenKey]
+// HashToKeyAlgo is HashToKey generalized to any of the algorithms WriteACI
+// accepts via WithHashAlgo.
+func (s Store) HashToKeyAlgo(algo HashAlgo, h hash.Hash) string {
+	return hashToKeyAlgo(algo, h)
 }